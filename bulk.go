@@ -0,0 +1,459 @@
+// Copyright 2017 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blevesearch/bleve"
+)
+
+// batchIndexer accumulates documents into a bleve.Batch and flushes it once
+// every size documents or every interval, whichever comes first - instead of
+// the one index.Index call per document the synchronous /add path does.
+type batchIndexer struct {
+	index    bleve.Index
+	size     int
+	interval time.Duration
+
+	mu    sync.Mutex
+	batch *bleve.Batch
+	count int
+}
+
+func newBatchIndexer(index bleve.Index, size int, interval time.Duration) *batchIndexer {
+	bi := &batchIndexer{index: index, size: size, interval: interval, batch: index.NewBatch()}
+	go bi.flushLoop()
+	return bi
+}
+
+func (bi *batchIndexer) flushLoop() {
+	t := time.NewTicker(bi.interval)
+	defer t.Stop()
+	for range t.C {
+		if err := bi.Flush(); err != nil {
+			Log.Error("flush batch", "error", err)
+		}
+	}
+}
+
+// Add stages id/doc into the current batch, flushing it if it reached size.
+func (bi *batchIndexer) Add(id string, doc interface{}) error {
+	bi.mu.Lock()
+	defer bi.mu.Unlock()
+	if err := bi.batch.Index(id, doc); err != nil {
+		return err
+	}
+	bi.count++
+	if bi.count >= bi.size {
+		return bi.flushLocked()
+	}
+	return nil
+}
+
+// Flush indexes the current batch, even if it's not yet full.
+func (bi *batchIndexer) Flush() error {
+	bi.mu.Lock()
+	defer bi.mu.Unlock()
+	return bi.flushLocked()
+}
+
+func (bi *batchIndexer) flushLocked() error {
+	if bi.count == 0 {
+		return nil
+	}
+	err := bi.index.Batch(bi.batch)
+	bi.batch = bi.index.NewBatch()
+	bi.count = 0
+	return err
+}
+
+// jobStatus tracks the progress of one asynchronously ingested document.
+type jobStatus struct {
+	mu     sync.RWMutex
+	status string
+	err    string
+}
+
+type jobStatusView struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (j *jobStatus) set(status string, err error) {
+	j.mu.Lock()
+	j.status = status
+	if err != nil {
+		j.err = err.Error()
+	}
+	j.mu.Unlock()
+}
+
+func (j *jobStatus) view() jobStatusView {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return jobStatusView{Status: j.status, Error: j.err}
+}
+
+// ingestStats backs GET /stats: queue depth, documents indexed so far, Tika
+// round-trip percentiles and the last ingest error seen.
+type ingestStats struct {
+	mu          sync.Mutex
+	docsIndexed int64
+	lastError   string
+	tikaRTTs    []time.Duration
+}
+
+func (s *ingestStats) addDocs(n int) {
+	s.mu.Lock()
+	s.docsIndexed += int64(n)
+	s.mu.Unlock()
+}
+
+func (s *ingestStats) recordError(err error) {
+	s.mu.Lock()
+	s.lastError = err.Error()
+	s.mu.Unlock()
+}
+
+func (s *ingestStats) observeTikaRTT(d time.Duration) {
+	const keep = 1000
+	s.mu.Lock()
+	s.tikaRTTs = append(s.tikaRTTs, d)
+	if len(s.tikaRTTs) > keep {
+		s.tikaRTTs = s.tikaRTTs[len(s.tikaRTTs)-keep:]
+	}
+	s.mu.Unlock()
+}
+
+func (s *ingestStats) percentiles() (p50, p95 time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.tikaRTTs) == 0 {
+		return 0, 0
+	}
+	sorted := append([]time.Duration(nil), s.tikaRTTs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	p50 = sorted[len(sorted)*50/100]
+	if i := len(sorted) * 95 / 100; i < len(sorted) {
+		p95 = sorted[i]
+	} else {
+		p95 = sorted[len(sorted)-1]
+	}
+	return p50, p95
+}
+
+func (s *ingestStats) snapshot() (docsIndexed int64, lastError string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.docsIndexed, s.lastError
+}
+
+// ingestTask is one unit of work handed to the worker pool.
+type ingestTask struct {
+	id    string
+	jobID string
+	body  io.ReadCloser
+}
+
+// ingestPool is a bounded worker pool that runs analyze+batched-store for
+// bulk/async ingest requests. The task channel's capacity provides the
+// back-pressure: once it is full, submit returns an error instead of
+// blocking the HTTP handler indefinitely.
+type ingestPool struct {
+	conf  config
+	tasks chan ingestTask
+	jobs  sync.Map // jobID -> *jobStatus
+	batch *batchIndexer
+	stats ingestStats
+	wg    sync.WaitGroup
+}
+
+func newIngestPool(conf config, workers, batchSize int, batchInterval time.Duration) *ingestPool {
+	p := &ingestPool{
+		conf:  conf,
+		tasks: make(chan ingestTask, workers*4),
+		batch: newBatchIndexer(conf.index, batchSize, batchInterval),
+	}
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+func (p *ingestPool) worker() {
+	for t := range p.tasks {
+		p.process(t)
+		p.wg.Done()
+	}
+}
+
+// Wait blocks until every queued and in-flight ingest task has finished -
+// used during graceful shutdown, after the HTTP server has stopped
+// accepting new requests.
+func (p *ingestPool) Wait() {
+	p.wg.Wait()
+	if err := p.batch.Flush(); err != nil {
+		Log.Error("flush final batch", "error", err)
+	}
+}
+
+func (p *ingestPool) process(t ingestTask) {
+	defer t.body.Close()
+	status, _ := p.jobs.Load(t.jobID)
+	js := status.(*jobStatus)
+	js.set("processing", nil)
+
+	start := time.Now()
+	docs, err := p.conf.analyze(context.Background(), t.body)
+	p.stats.observeTikaRTT(time.Since(start))
+	if err != nil {
+		js.set("error", err)
+		p.stats.recordError(err)
+		return
+	}
+	if len(docs) == 0 {
+		err = fmt.Errorf("Tika returned no documents")
+		js.set("error", err)
+		p.stats.recordError(err)
+		return
+	}
+	docs[0].ID = t.id
+	for i := 1; i < len(docs); i++ {
+		docs[i].ID = fmt.Sprintf("%s/%d", t.id, i)
+		docs[i].ParentID = t.id
+	}
+	for _, doc := range docs {
+		if err = p.batch.Add(doc.ID, doc); err != nil {
+			js.set("error", err)
+			p.stats.recordError(err)
+			return
+		}
+	}
+	p.stats.addDocs(len(docs))
+	js.set("done", nil)
+}
+
+// queueDepth reports how many tasks are waiting to be picked up by a worker.
+func (p *ingestPool) queueDepth() int { return len(p.tasks) }
+
+// submit enqueues a task and returns its job ID, or an error if the queue is
+// full (back-pressure).
+func (p *ingestPool) submit(id string, body io.ReadCloser) (string, error) {
+	jobID := newRequestID()
+	js := &jobStatus{status: "queued"}
+	p.jobs.Store(jobID, js)
+	p.wg.Add(1)
+	select {
+	case p.tasks <- ingestTask{id: id, jobID: jobID, body: body}:
+		return jobID, nil
+	default:
+		p.wg.Done()
+		p.jobs.Delete(jobID)
+		return "", fmt.Errorf("ingest queue is full, try again later")
+	}
+}
+
+// bulkHandler serves POST /bulk: a multipart form with many files, or a
+// tar/zip stream, each entry submitted as its own ingest job.
+func (p *ingestPool) bulkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "invalid method; allowed: POST", http.StatusMethodNotAllowed)
+		return
+	}
+	ct := r.Header.Get("Content-Type")
+	var (
+		jobIDs []string
+		err    error
+	)
+	switch {
+	case strings.HasPrefix(ct, "multipart/form-data"):
+		jobIDs, err = p.submitMultipart(r)
+	case ct == "application/x-tar":
+		jobIDs, err = p.submitTar(r.Body)
+	case ct == "application/zip":
+		jobIDs, err = p.submitZip(r.Body)
+	default:
+		http.Error(w, fmt.Sprintf("unsupported Content-Type %q; want multipart/form-data, application/x-tar or application/zip", ct), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{"jobs": jobIDs})
+}
+
+func (p *ingestPool) submitMultipart(r *http.Request) ([]string, error) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		return nil, err
+	}
+	var jobIDs []string
+	for name, headers := range r.MultipartForm.File {
+		for _, h := range headers {
+			f, err := h.Open()
+			if err != nil {
+				return jobIDs, err
+			}
+			id := h.Filename
+			if id == "" {
+				id = name
+			}
+			jobID, err := p.submit(id, f)
+			if err != nil {
+				f.Close()
+				return jobIDs, err
+			}
+			jobIDs = append(jobIDs, jobID)
+		}
+	}
+	return jobIDs, nil
+}
+
+func (p *ingestPool) submitTar(r io.Reader) ([]string, error) {
+	tr := tar.NewReader(r)
+	var jobIDs []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return jobIDs, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, tr); err != nil {
+			return jobIDs, err
+		}
+		jobID, err := p.submit(hdr.Name, ioutil.NopCloser(&buf))
+		if err != nil {
+			return jobIDs, err
+		}
+		jobIDs = append(jobIDs, jobID)
+	}
+	return jobIDs, nil
+}
+
+func (p *ingestPool) submitZip(r io.Reader) ([]string, error) {
+	// zip.NewReader needs an io.ReaderAt, so the stream has to be buffered
+	// fully before it can be opened.
+	var buf bytes.Buffer
+	size, err := io.Copy(&buf, r)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), size)
+	if err != nil {
+		return nil, err
+	}
+	var jobIDs []string
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return jobIDs, err
+		}
+		jobID, err := p.submit(f.Name, rc)
+		if err != nil {
+			return jobIDs, err
+		}
+		jobIDs = append(jobIDs, jobID)
+	}
+	return jobIDs, nil
+}
+
+// addAsyncHandler serves PUT /add-async: like /add, but returns 202 with a
+// job ID right away instead of waiting for analyze+store to finish.
+func (p *ingestPool) addAsyncHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		http.Error(w, "invalid method; allowed: PUT", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "id is required!", http.StatusBadRequest)
+		return
+	}
+	// r.Body is closed by net/http as soon as this handler returns, but
+	// submit hands it to a worker that may dequeue it long after that -
+	// drain it into memory first, as submitTar/submitZip already do.
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r.Body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	jobID, err := p.submit(id, ioutil.NopCloser(&buf))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"job": jobID})
+}
+
+// jobHandler serves GET /jobs/{id}.
+func (p *ingestPool) jobHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "invalid method; allowed: GET", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	v, ok := p.jobs.Load(id)
+	if !ok {
+		http.Error(w, fmt.Sprintf("job %q not found", id), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v.(*jobStatus).view())
+}
+
+// statsHandler serves GET /stats.
+func (p *ingestPool) statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "invalid method; allowed: GET", http.StatusMethodNotAllowed)
+		return
+	}
+	p50, p95 := p.stats.percentiles()
+	docsIndexed, lastError := p.stats.snapshot()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"queue_depth":  p.queueDepth(),
+		"docs_indexed": docsIndexed,
+		"tika_rtt_p50": p50.String(),
+		"tika_rtt_p95": p95.String(),
+		"last_error":   lastError,
+	})
+}
@@ -0,0 +1,79 @@
+// Copyright 2017 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve"
+)
+
+// TestAddAsyncHandlerRoundTrip drives PUT /add-async over a real HTTP round
+// trip, as net/http closes the request body right after the handler
+// returns - submit must not be handed that body directly, or the worker
+// reads it too late and the document is silently dropped.
+func TestAddAsyncHandlerRoundTrip(t *testing.T) {
+	tika := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `[{"Content-Type":"text/plain","X-TIKA:content":"hello world"}]`)
+	}))
+	defer tika.Close()
+
+	index, err := bleve.NewMemOnly(indexMapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	conf := config{
+		index:      index,
+		httpClient: tika.Client(),
+		tika:       newTikaSupervisor("", "", 0, tika.URL, tika.Client(), time.Second),
+	}
+	pool := newIngestPool(conf, 1, 1, time.Hour)
+
+	srv := httptest.NewServer(http.HandlerFunc(pool.addAsyncHandler))
+	defer srv.Close()
+
+	req, err := http.NewRequest("PUT", srv.URL+"/add-async?id=doc1", strings.NewReader("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if doc, err := index.Document("doc1"); err == nil && doc != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("document was never indexed - body was likely read after the request closed it")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2017 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/abadojack/whatlanggo"
+)
+
+// defaultAnalyzer is the generic Bleve analyzer (and document mapping
+// suffix) used when the detected language isn't one we have a dedicated
+// analyzer for, or when detection wasn't confident enough.
+const defaultAnalyzer = "standard"
+
+// languageAnalyzers maps a detected ISO 639-3 language code to the Bleve
+// analyzer registered for it.
+var languageAnalyzers = map[string]string{
+	"eng": "en",
+	"hun": "hu",
+	"deu": "de",
+}
+
+// mappedAnalyzers lists every analyzer a "tika_"+analyzer document mapping
+// must exist for: the generic fallback plus every language-specific one.
+func mappedAnalyzers() []string {
+	analyzers := []string{defaultAnalyzer}
+	seen := map[string]bool{defaultAnalyzer: true}
+	for _, a := range languageAnalyzers {
+		if !seen[a] {
+			seen[a] = true
+			analyzers = append(analyzers, a)
+		}
+	}
+	return analyzers
+}
+
+// detectLanguage runs a language detector over text and returns the analyzer
+// (and "tika_"+analyzer document mapping) to route the document to, falling
+// back to defaultAnalyzer when text is blank, when the detector's confidence
+// is below langMinConfidence, or when the detected language has no entry in
+// languageAnalyzers.
+func (c config) detectLanguage(text string) string {
+	if strings.TrimSpace(text) == "" {
+		return defaultAnalyzer
+	}
+	info := whatlanggo.Detect(text)
+	if info.Confidence < c.langMinConfidence {
+		return defaultAnalyzer
+	}
+	if analyzer, ok := languageAnalyzers[info.Lang.Iso6393()]; ok {
+		return analyzer
+	}
+	return defaultAnalyzer
+}
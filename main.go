@@ -16,22 +16,20 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"os"
-	"os/exec"
-	"strconv"
-	"sync"
+	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/blevesearch/bleve"
+	"github.com/opentracing/opentracing-go"
 	"github.com/tgulacsi/go/loghlp"
 	"gopkg.in/inconshreveable/log15.v2"
 )
@@ -50,16 +48,45 @@ func main() {
 	flagTikaJar := flag.String("tika-jar", "/usr/local/share/java/tika-server.jar", "absolute path of the Tika jar")
 	flagTikaPort := flag.Int("tika-port", 9998, "Tika port")
 	flagIndex := flag.String("index", "/data/index.bleve", "absolute path of the Bleve index file")
+	flagTracingBackend := flag.String("tracing-backend", "none", "tracing backend: jaeger, zipkin, otlp, none")
+	flagTracingEndpoint := flag.String("tracing-endpoint", "", "tracing collector/agent endpoint")
+	flagTracingServiceName := flag.String("tracing-service-name", "bleve-indexer", "service name reported to the tracer")
+	flagTracingSampleRate := flag.Float64("tracing-sample-rate", 1.0, "fraction of requests to sample (0..1)")
+	flagReadOnly := flag.Bool("read-only", false, "reject all requests except GET, HEAD and POST /search with 405, for maintenance windows")
+	flagWorkers := flag.Int("workers", 4, "bulk/async ingest worker pool size")
+	flagBatchSize := flag.Int("batch-size", 100, "flush the Bleve batch after this many documents")
+	flagBatchInterval := flag.Duration("batch-interval", 2*time.Second, "flush the Bleve batch after this much time, even if batch-size wasn't reached")
+	flagLangMinConfidence := flag.Float64("lang-min-confidence", 0.5, "minimum language-detection confidence (0..1); below this, fall back to the standard analyzer")
+	flagTikaURL := flag.String("tika-url", "", "externally managed Tika base URL; if set, Tika is not forked and -java/-tika-jar/-tika-port are ignored")
+	flagTikaTimeout := flag.Duration("tika-timeout", 30*time.Second, "per-request timeout for calls to Tika")
+	flagTikaStartupTimeout := flag.Duration("tika-startup-timeout", 30*time.Second, "how long to wait for Tika to become ready on startup")
 	flag.Parse()
 
 	if !*flagVerbose {
 		Log.SetHandler(log15.LvlFilterHandler(log15.LvlInfo, log15.StderrHandler))
 	}
 
-	conf := config{java: *flagJavaBin, jar: *flagTikaJar, tikaPort: *flagTikaPort,
-		httpClient: http.DefaultClient,
+	tracerCloser, err := initTracer(*flagTracingBackend, *flagTracingEndpoint, *flagTracingServiceName, *flagTracingSampleRate)
+	if err != nil {
+		Log.Crit("init tracing", "error", err)
+		os.Exit(1)
+	}
+	defer tracerCloser.Close()
+
+	httpClient := &http.Client{
+		Transport: &tracingTransport{rt: &http.Transport{
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: 16,
+			IdleConnTimeout:     90 * time.Second,
+		}},
+		Timeout: *flagTikaTimeout,
 	}
-	_, err := os.Stat(*flagIndex)
+	conf := config{
+		httpClient:        httpClient,
+		langMinConfidence: *flagLangMinConfidence,
+		tika:              newTikaSupervisor(*flagJavaBin, *flagTikaJar, *flagTikaPort, *flagTikaURL, httpClient, *flagTikaTimeout),
+	}
+	_, err = os.Stat(*flagIndex)
 	if err == nil { //exist
 		conf.index, err = bleve.Open(*flagIndex)
 	} else {
@@ -71,30 +98,59 @@ func main() {
 	}
 	defer conf.index.Close()
 
-	Log.Info("Trying Tika server")
-	if err := conf.ensureTikaServer(); err != nil {
+	Log.Info("Starting Tika server")
+	if err := conf.tika.Start(*flagTikaStartupTimeout); err != nil {
 		Log.Crit("Start Tika server", "error", err)
 		os.Exit(1)
 	}
 
 	Log.Info("Tika server started successfully.")
-	http.HandleFunc("/search", conf.searchHandler)
-	http.HandleFunc("/add", conf.addHandler)
-	http.HandleFunc("/", conf.rootHandler)
+	pool := newIngestPool(conf, *flagWorkers, *flagBatchSize, *flagBatchInterval)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/search", conf.searchHandler)
+	mux.HandleFunc("/add", conf.addHandler)
+	mux.HandleFunc("/add-async", pool.addAsyncHandler)
+	mux.HandleFunc("/bulk", pool.bulkHandler)
+	mux.HandleFunc("/jobs/", pool.jobHandler)
+	mux.HandleFunc("/stats", pool.statsHandler)
+	mux.HandleFunc("/doc/", conf.docHandler)
+	mux.HandleFunc("/", conf.rootHandler)
+
+	handler := chain(mux,
+		requestIDMiddleware,
+		recoverMiddleware,
+		accessLogMiddleware,
+		readOnlyMiddleware(flagReadOnly),
+	)
+
+	srv := &http.Server{Addr: *flagAddr, Handler: handler}
+	go func() {
+		Log.Info("Listening on " + *flagAddr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			Log.Error("Running", "error", err)
+		}
+	}()
 
-	Log.Info("Listening on " + *flagAddr)
-	Log.Info("Running", "error", http.ListenAndServe(*flagAddr, nil))
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	<-sigCh
+
+	Log.Info("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		Log.Warn("shutdown HTTP server", "error", err)
+	}
+	pool.Wait()
+	conf.tika.Shutdown()
 }
 
 type config struct {
-	index      bleve.Index
-	java, jar  string
-	tikaPort   int
-	httpClient *http.Client
-
-	tikaMu sync.Mutex
-	tika   *os.Process
-	tikaCh chan error
+	index             bleve.Index
+	httpClient        *http.Client
+	langMinConfidence float64
+	tika              *tikaSupervisor
 }
 
 func (c config) rootHandler(w http.ResponseWriter, r *http.Request) {
@@ -109,36 +165,19 @@ func (c config) rootHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (c config) putHandler(w http.ResponseWriter, r *http.Request) {
-	if err := c.ensureTikaServer(); err != nil {
-		http.Error(w, fmt.Sprintf("Cannot start Tika server: %v", err), http.StatusInternalServerError)
-		return
-	}
 }
 func (c config) getHandler(w http.ResponseWriter, r *http.Request) {
 }
 
-func (c config) searchHandler(w http.ResponseWriter, r *http.Request) {
-	q := r.URL.Query().Get("q")
-	Log.Info("search", "q", q)
-	qry := bleve.NewQueryStringQuery(q)
-	results, err := c.index.Search(bleve.NewSearchRequest(qry))
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Search (%q): %v", q, err), http.StatusInternalServerError)
-		return
-	}
-	fmt.Fprintf(w, "Results: %+v\n", results)
-}
 func (c config) addHandler(w http.ResponseWriter, r *http.Request) {
-	if err := c.ensureTikaServer(); err != nil {
-		http.Error(w, fmt.Sprintf("Start Tika server: %v", err), http.StatusInternalServerError)
-		return
-	}
+	span, ctx := startRequestSpan(r, "addHandler")
+	defer span.Finish()
 
 	ct := r.Header.Get("Content-Type")
 	defer r.Body.Close()
 	var id string
 	bdy := io.ReadCloser(r.Body)
-	if ct == "multipart/form-data" || ct == "application/x-www-form-encoded" {
+	if strings.HasPrefix(ct, "multipart/form-data") || ct == "application/x-www-form-encoded" {
 		if err := r.ParseForm(); err != nil {
 			http.Error(w, fmt.Sprintf("cannot parse request: %v", err), http.StatusBadRequest)
 			return
@@ -166,92 +205,67 @@ func (c config) addHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	meta, text, err := c.analyze(r.Body)
+	docs, err := c.analyze(ctx, bdy)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("analyze: %v", err), http.StatusInternalServerError)
 		return
 	}
-	Log.Debug("analyze", "meta", meta, "text", text)
-	if err = c.store(id, meta, text); err != nil {
+	if len(docs) == 0 {
+		http.Error(w, "Tika returned no documents", http.StatusInternalServerError)
+		return
+	}
+	docs[0].ID = id
+	for i := 1; i < len(docs); i++ {
+		docs[i].ID = fmt.Sprintf("%s/%d", id, i)
+		docs[i].ParentID = id
+	}
+	requestLogger(r).Debug("analyze", "docs", docs)
+	if err = c.store(ctx, docs); err != nil {
 		http.Error(w, fmt.Sprintf("store: %v", err), http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(&document{ID: id, metadata: meta})
+	json.NewEncoder(w).Encode(&docs[0])
 }
 
-func (c config) store(ID string, meta metadata, text string) error {
-	doc := document{ID: ID, metadata: meta, Text: text}
-	Log.Debug("Index", "document", doc)
-	return c.index.Index(ID, doc)
-}
-
-func (c config) analyze(r io.Reader) (metadata, string, error) {
-	var (
-		meta metadata
-		text string
-		buf  bytes.Buffer
-	)
+// store indexes docs one by one - docs[0] is the container document, the
+// rest (if any) are its embedded attachments, linked to it via ParentID.
+func (c config) store(ctx context.Context, docs []document) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "store")
+	defer span.Finish()
 
-	baseUrl := "http://localhost:" + strconv.Itoa(c.tikaPort)
-	// buffer data in memory
-	r2 := io.TeeReader(r, &buf)
-	// meta
-	req, err := http.NewRequest("PUT", baseUrl+"/meta", r2)
-	if err != nil {
-		return meta, text, err
-	}
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return meta, text, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= http.StatusBadRequest {
-		return meta, text, err
-	}
-	meta, err = readMeta(resp.Body)
-
-	// buffer remaining data
-	if _, err = io.Copy(ioutil.Discard, r2); err != nil {
-		return meta, text, err
-	}
-
-	// get text
-	if req, err = http.NewRequest("PUT", baseUrl+"/tika", bytes.NewReader(buf.Bytes())); err != nil {
-		return meta, text, err
-	}
-	if resp, err = c.httpClient.Do(req); err != nil {
-		return meta, text, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= http.StatusBadRequest {
-		return meta, text, err
-	}
-	b, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return meta, text, err
+	for _, doc := range docs {
+		Log.Debug("Index", "document", doc)
+		if err := c.index.Index(doc.ID, doc); err != nil {
+			return err
+		}
 	}
-	text = string(b)
-	return meta, text, err
+	return nil
 }
 
 var _ bleve.Classifier = document{}
 
 type document struct {
-	ID string `json:"id"`
+	ID       string `json:"id"`
+	ParentID string `json:"parent_id,omitempty"`
+	Language string `json:"language,omitempty"`
 	metadata
 	Text string `json:"text"`
 }
 
+// Type routes the document to its per-language mapping (e.g. "tika_hu"),
+// falling back to the generic "tika_standard" mapping when Language wasn't
+// set confidently enough by detectLanguage.
 func (d document) Type() string {
-	//return d.metadata.ContentType
-	return "tika"
+	if d.Language == "" {
+		return "tika_" + defaultAnalyzer
+	}
+	return "tika_" + d.Language
 }
 
 func init() {
 	authorFieldMapping := bleve.NewTextFieldMapping()
-	//authorFieldMapping.Analyzer = "hu"
 	ctFieldMapping := bleve.NewTextFieldMapping()
 	titleFieldMapping := bleve.NewTextFieldMapping()
 	createdFieldMapping := bleve.NewDateTimeFieldMapping()
@@ -266,149 +280,24 @@ func init() {
 	metaMapping.AddSubDocumentMapping("Data", dataFieldMapping)
 
 	idFieldMapping := bleve.NewTextFieldMapping()
-	textFieldMapping := bleve.NewTextFieldMapping()
-	//textFieldMapping.Analyzer = "hu"
-
-	tikaMapping := bleve.NewDocumentMapping()
-	tikaMapping.AddFieldMappingsAt("ID", idFieldMapping)
-	tikaMapping.AddSubDocumentMapping("metadata", metaMapping)
-	tikaMapping.AddFieldMappingsAt("Text", textFieldMapping)
+	parentIDFieldMapping := bleve.NewTextFieldMapping()
+	languageFieldMapping := bleve.NewTextFieldMapping()
 
 	indexMapping = bleve.NewIndexMapping()
-	indexMapping.AddDocumentMapping("tika", tikaMapping)
-}
-
-type metadata struct {
-	Author      string            `json:"author"`
-	ContentType string            `json:"content-type"`
-	Title       string            `json:"title"`
-	Data        map[string]string `json:"data"`
-	Created     time.Time         `json:"created"`
-}
-
-/*
-"cp:revision","2"
-"meta:last-author","altbac"
-"Last-Author","altbac"
-"meta:save-date","2013-05-03T07:46:00Z"
-"Author","altbac"
-"dcterms:created","2013-05-03T07:46:00Z"
-"date","2013-05-03T07:46:00Z"
-"extended-properties:Template","Normal"
-"creator","altbac"
-"Edit-Time","600000000"
-"Creation-Date","2013-05-03T07:46:00Z"
-"title","A BAGOLY TANODA NYÁRI TÁBORA"
-"meta:author","altbac"
-"dc:title","A BAGOLY TANODA NYÁRI TÁBORA"
-"Last-Save-Date","2013-05-03T07:46:00Z"
-"Revision-Number","2"
-"Last-Printed","1601-01-01T00:00:00Z"
-"meta:print-date","1601-01-01T00:00:00Z"
-"meta:creation-date","2013-05-03T07:46:00Z"
-"dcterms:modified","2013-05-03T07:46:00Z"
-"Template","Normal"
-"dc:creator","altbac"
-"Last-Modified","2013-05-03T07:46:00Z"
-"X-Parsed-By","org.apache.tika.parser.ParserDecorator$1","org.apache.tika.parser.microsoft.OfficeParser"
-"modified","2013-05-03T07:46:00Z"
-"Content-Type","application/msword"
-*/
-func readMeta(r io.Reader) (metadata, error) {
-	var meta metadata
-	scanner := bufio.NewScanner(r)
-	scanner.Split(bufio.ScanLines)
-	for scanner.Scan() {
-		line := bytes.TrimLeft(bytes.TrimRight(scanner.Bytes(), "\"\n"), `"`)
-		i := bytes.Index(line, []byte(`","`))
-		if i < 0 {
-			Log.Warn("no field separator", "line", scanner.Text())
-			continue
-		}
-		key := string(line[:i])
-		value := string(bytes.Replace(line[i+3:], []byte{'"'}, []byte{}, -1))
-		Log.Debug("scan", "key", key, "value", value)
-
-		switch key {
-		case "Content-Type":
-			meta.ContentType = value
-		case "Author":
-			meta.Author = value
-		case "Creation-Date":
-			var err error
-			if meta.Created, err = time.Parse(time.RFC3339, value); err != nil {
-				Log.Warn("parse Creation-Date", "text", value, "error", err)
-			}
-		case "title":
-			meta.Title = value
-		default:
-			if meta.Data == nil {
-				meta.Data = make(map[string]string, 32)
-			}
-			meta.Data[key] = value
-		}
+	// One document mapping per known analyzer, named "tika_"+analyzer, so
+	// document.Type() can route each document to the analyzer matching its
+	// detected Language (see lang.go), plus "tika_standard" as the fallback.
+	for _, analyzer := range mappedAnalyzers() {
+		textFieldMapping := bleve.NewTextFieldMapping()
+		textFieldMapping.Analyzer = analyzer
+
+		tikaMapping := bleve.NewDocumentMapping()
+		tikaMapping.AddFieldMappingsAt("ID", idFieldMapping)
+		tikaMapping.AddFieldMappingsAt("ParentID", parentIDFieldMapping)
+		tikaMapping.AddFieldMappingsAt("Language", languageFieldMapping)
+		tikaMapping.AddSubDocumentMapping("metadata", metaMapping)
+		tikaMapping.AddFieldMappingsAt("Text", textFieldMapping)
+
+		indexMapping.AddDocumentMapping("tika_"+analyzer, tikaMapping)
 	}
-	return meta, scanner.Err()
-}
-
-// ensureTikaServer checks whether the Tika server runs, and starts it if not.
-// Writes the PID to config.tikaPID
-func (c *config) ensureTikaServer() error {
-	c.tikaMu.Lock()
-	defer c.tikaMu.Unlock()
-	if c.tikaCh != nil {
-		select {
-		case err := <-c.tikaCh:
-			Log.Error("Tika stopped", "error", err)
-		default:
-			return nil
-		}
-		close(c.tikaCh)
-	}
-	c.tikaCh = make(chan error, 1)
-	cmd := exec.Command(c.java, "-jar", c.jar, "-h", "localhost", "-p", strconv.Itoa(c.tikaPort))
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	Log.Info("Starting Tika", "args", cmd.Args)
-	if err := cmd.Start(); err != nil {
-		return err
-	}
-	c.tika = cmd.Process
-	go func() {
-		err := cmd.Wait()
-		Log.Info("Tika ended", "error", err)
-		c.tikaCh <- err
-	}()
-	select {
-	case err := <-c.tikaCh:
-		return err
-	case <-time.After(100 * time.Millisecond):
-		return nil
-	}
-}
-
-func (c *config) killTikaServer() error {
-	c.tikaMu.Lock()
-	defer c.tikaMu.Unlock()
-	if c.tika == nil {
-		return nil
-	}
-	tika := c.tika
-	c.tika = nil
-	exited := make(chan struct{}, 1)
-	go func() {
-		_, _ = tika.Wait()
-		exited <- struct{}{}
-	}()
-	if err := tika.Signal(syscall.SIGTERM); err != nil {
-		Log.Warn("TERMinating Tika", "pid", tika.Pid, "error", err)
-	}
-	select {
-	case <-exited:
-	case <-time.After(5 * time.Second):
-		if err := tika.Kill(); err != nil {
-			Log.Warn("KILLing Tika", "pid", tika.Pid, "error", err)
-		}
-	}
-	return nil
 }
@@ -0,0 +1,150 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// middleware wraps an http.Handler with additional behavior.
+type middleware func(http.Handler) http.Handler
+
+// chain applies mws to h in order, so mws[0] ends up the outermost handler.
+func chain(h http.Handler, mws ...middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+type ctxKey int
+
+const (
+	ctxKeyRequestID ctxKey = iota
+	ctxKeyLogger
+)
+
+// requestIDMiddleware reads (or generates) an X-Request-ID, echoes it back
+// on the response, and stashes it - along with a logger tagged with it - in
+// the request context for downstream handlers and middlewares.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), ctxKeyRequestID, id)
+		ctx = context.WithValue(ctx, ctxKeyLogger, Log.New("reqID", id))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// newRequestID returns a random hex-encoded request identifier.
+func newRequestID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// requestLogger returns the per-request logger stashed by
+// requestIDMiddleware, falling back to the package-level Log if none is set.
+func requestLogger(r *http.Request) log15.Logger {
+	if lg, ok := r.Context().Value(ctxKeyLogger).(log15.Logger); ok {
+		return lg
+	}
+	return Log
+}
+
+// statusRecorder wraps an http.ResponseWriter to capture the status code and
+// byte count written, for access logging.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.bytes += n
+	return n, err
+}
+
+// accessLogMiddleware emits one structured log line per request: method,
+// path, status, bytes, duration and request ID.
+func accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			requestLogger(r).Info("access",
+				"method", r.Method, "path", r.URL.Path,
+				"status", rec.status, "bytes", rec.bytes,
+				"duration", time.Since(start))
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// recoverMiddleware turns a panic in a downstream handler into a 500
+// response, logging the stack trace instead of taking the server down.
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				requestLogger(r).Error("panic", "error", rec, "stack", string(debug.Stack()))
+				http.Error(w, "internal error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readOnlyMiddleware rejects every request other than GET, HEAD and
+// POST /search (a query, not a write) while readOnly is true, leaving
+// /search and every other read-only endpoint working - for maintenance
+// windows. Gating by method rather than by path keeps newly added mutating
+// endpoints (e.g. /add-async, /bulk) covered automatically.
+func readOnlyMiddleware(readOnly *bool) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if *readOnly && r.Method != "GET" && r.Method != "HEAD" &&
+				!(r.Method == "POST" && r.URL.Path == "/search") {
+				http.Error(w, "server is in read-only mode", http.StatusMethodNotAllowed)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/blevesearch/bleve"
+)
+
+// searchHandler serves GET /search?q=... as a NewQueryStringQuery shortcut,
+// and POST /search with a JSON-encoded bleve.SearchRequest body, giving
+// callers the full query DSL (term/match/phrase/bool/date-range/
+// numeric-range, facets, highlighting, from/size/fields/sort).
+func (c config) searchHandler(w http.ResponseWriter, r *http.Request) {
+	span, _ := startRequestSpan(r, "searchHandler")
+	defer span.Finish()
+
+	switch r.Method {
+	case "GET":
+		q := r.URL.Query().Get("q")
+		requestLogger(r).Info("search", "q", q)
+		c.runSearch(w, r, bleve.NewSearchRequest(bleve.NewQueryStringQuery(q)))
+	case "POST":
+		defer r.Body.Close()
+		var req bleve.SearchRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("decode search request: %v", err), http.StatusBadRequest)
+			return
+		}
+		requestLogger(r).Info("search", "request", req)
+		c.runSearch(w, r, &req)
+	default:
+		http.Error(w, "invalid method; allowed: GET,POST", http.StatusMethodNotAllowed)
+	}
+}
+
+func (c config) runSearch(w http.ResponseWriter, r *http.Request, req *bleve.SearchRequest) {
+	results, err := c.index.Search(req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("search: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// docHandler serves GET /doc/{id}, returning the stored fields of a single
+// indexed document.
+func (c config) docHandler(w http.ResponseWriter, r *http.Request) {
+	span, _ := startRequestSpan(r, "docHandler")
+	defer span.Finish()
+
+	if r.Method != "GET" {
+		http.Error(w, "invalid method; allowed: GET", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/doc/")
+	if id == "" {
+		http.Error(w, "id is required", http.StatusBadRequest)
+		return
+	}
+	doc, err := c.index.Document(id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("get document %q: %v", id, err), http.StatusInternalServerError)
+		return
+	}
+	if doc == nil {
+		http.Error(w, fmt.Sprintf("document %q not found", id), http.StatusNotFound)
+		return
+	}
+	fields := make(map[string]interface{}, len(doc.Fields))
+	for _, f := range doc.Fields {
+		fields[f.Name()] = string(f.Value())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fields)
+}
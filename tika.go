@@ -0,0 +1,143 @@
+// Copyright 2015 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+// tikaContentKey is the key Tika's /rmeta endpoints use for the extracted text
+// of a (possibly embedded) document.
+const tikaContentKey = "X-TIKA:content"
+
+// analyze streams r to Tika's /rmeta/text endpoint, which returns one JSON
+// object per embedded document (the first being the document itself, the
+// rest being attachments found inside containers such as e-mails or zips).
+// The request body is streamed straight through to Tika instead of being
+// buffered in memory first.
+func (c config) analyze(ctx context.Context, r io.Reader) ([]document, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "analyze")
+	defer span.Finish()
+
+	if err := c.tika.acquire(); err != nil {
+		return nil, err
+	}
+	defer c.tika.release()
+
+	req, err := http.NewRequest("PUT", c.tika.baseURL()+"/rmeta/text", r)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("rmeta: %s: %s", resp.Status, b)
+	}
+
+	var raw []json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("decode rmeta response: %v", err)
+	}
+
+	docs := make([]document, len(raw))
+	for i, entry := range raw {
+		var meta metadata
+		if err := json.Unmarshal(entry, &meta); err != nil {
+			return nil, fmt.Errorf("unmarshal metadata %d: %v", i, err)
+		}
+		var content struct {
+			Text string `json:"X-TIKA:content"`
+		}
+		if err := json.Unmarshal(entry, &content); err != nil {
+			return nil, fmt.Errorf("unmarshal content %d: %v", i, err)
+		}
+		docs[i] = document{metadata: meta, Text: content.Text}
+		docs[i].Language = c.detectLanguage(docs[i].Text)
+	}
+	return docs, nil
+}
+
+// metadata holds the Dublin Core / Tika metadata fields we care about, plus
+// whatever else Tika reports under Data.
+type metadata struct {
+	Author      string            `json:"author"`
+	ContentType string            `json:"content-type"`
+	Title       string            `json:"title"`
+	Data        map[string]string `json:"data"`
+	Created     time.Time         `json:"created"`
+}
+
+// UnmarshalJSON maps Tika's rmeta keys (Dublin Core names such as dc:title,
+// dc:creator, dcterms:created, plus the plain Content-Type/title/Author
+// aliases) onto the metadata fields, and stores everything else in Data.
+func (m *metadata) UnmarshalJSON(p []byte) error {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(p, &raw); err != nil {
+		return err
+	}
+	for key, value := range raw {
+		s, _ := value.(string)
+		switch key {
+		case tikaContentKey:
+			// handled separately by the caller, not metadata
+
+		case "dc:title", "title":
+			m.Title = s
+		case "dc:creator", "Author", "meta:author", "creator":
+			if m.Author == "" {
+				m.Author = s
+			}
+		case "dcterms:created", "Creation-Date", "meta:creation-date":
+			if m.Created.IsZero() {
+				if t, err := parseTikaTime(s); err == nil {
+					m.Created = t
+				} else {
+					Log.Warn("parse "+key, "text", s, "error", err)
+				}
+			}
+		case "Content-Type":
+			m.ContentType = s
+		default:
+			if s == "" {
+				continue
+			}
+			if m.Data == nil {
+				m.Data = make(map[string]string, 32)
+			}
+			m.Data[key] = s
+		}
+	}
+	return nil
+}
+
+// parseTikaTime parses the RFC3339 timestamps Tika emits for date metadata.
+func parseTikaTime(s string) (time.Time, error) {
+	return time.Parse(time.RFC3339, s)
+}
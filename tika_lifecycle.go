@@ -0,0 +1,245 @@
+// Copyright 2017 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	probeInterval = 5 * time.Second
+	minBackoff    = time.Second
+	maxBackoff    = 30 * time.Second
+)
+
+// tikaSupervisor owns the lifecycle of the Tika server: starting it (unless
+// it's externally managed), waiting for it to become ready, periodically
+// probing it for liveness, and restarting it with capped exponential backoff
+// when it stops answering. analyze (tika.go) brackets every call to Tika
+// with acquire/release so a restart can drain in-flight requests first.
+type tikaSupervisor struct {
+	java, jar   string
+	port        int
+	externalURL string
+	httpClient  *http.Client
+	timeout     time.Duration
+
+	mu       sync.Mutex
+	proc     *os.Process
+	exited   chan struct{} // closed by spawn's reaper once proc has been Wait()-ed
+	draining bool
+
+	inflight sync.WaitGroup
+}
+
+func newTikaSupervisor(java, jar string, port int, externalURL string, httpClient *http.Client, timeout time.Duration) *tikaSupervisor {
+	return &tikaSupervisor{
+		java: java, jar: jar, port: port,
+		externalURL: externalURL, httpClient: httpClient, timeout: timeout,
+	}
+}
+
+// managed reports whether this supervisor forks and owns the Tika process,
+// as opposed to merely probing one started elsewhere (-tika-url).
+func (s *tikaSupervisor) managed() bool { return s.externalURL == "" }
+
+func (s *tikaSupervisor) baseURL() string {
+	if s.externalURL != "" {
+		return s.externalURL
+	}
+	return "http://localhost:" + strconv.Itoa(s.port)
+}
+
+// Start brings Tika up (forking it unless externally managed), blocks until
+// it answers GET /tika or readyTimeout elapses, and launches the background
+// liveness-probe loop.
+func (s *tikaSupervisor) Start(readyTimeout time.Duration) error {
+	if s.managed() {
+		if err := s.spawn(); err != nil {
+			return err
+		}
+	}
+	if err := s.waitReady(readyTimeout); err != nil {
+		return err
+	}
+	go s.superviseLoop()
+	return nil
+}
+
+func (s *tikaSupervisor) waitReady(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	var lastErr error
+	for {
+		if lastErr = s.probe("/tika"); lastErr == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("tika not ready after %s: %v", timeout, lastErr)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func (s *tikaSupervisor) probe(path string) error {
+	req, err := http.NewRequest("GET", s.baseURL()+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", path, resp.Status)
+	}
+	return nil
+}
+
+// superviseLoop periodically probes /version as a liveness check. When the
+// probe fails on a process we forked ourselves, it restarts Tika with
+// exponential backoff, capped at maxBackoff; for an externally managed Tika
+// it just logs the failure, since there's nothing to restart.
+func (s *tikaSupervisor) superviseLoop() {
+	t := time.NewTicker(probeInterval)
+	defer t.Stop()
+	backoff := minBackoff
+	for range t.C {
+		if err := s.probe("/version"); err == nil {
+			backoff = minBackoff
+			continue
+		} else {
+			Log.Warn("tika liveness probe failed", "error", err)
+		}
+		if !s.managed() {
+			continue
+		}
+		if err := s.restart(); err != nil {
+			Log.Error("restart tika", "error", err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		backoff = minBackoff
+	}
+}
+
+// restart drains in-flight analyze calls, kills the current Tika process and
+// starts a fresh one, waiting for it to become ready.
+func (s *tikaSupervisor) restart() error {
+	s.mu.Lock()
+	s.draining = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.draining = false
+		s.mu.Unlock()
+	}()
+
+	s.inflight.Wait()
+	if err := s.kill(); err != nil {
+		Log.Warn("kill tika before restart", "error", err)
+	}
+	if err := s.spawn(); err != nil {
+		return err
+	}
+	return s.waitReady(s.timeout)
+}
+
+func (s *tikaSupervisor) spawn() error {
+	cmd := exec.Command(s.java, "-jar", s.jar, "-h", "localhost", "-p", strconv.Itoa(s.port))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	Log.Info("Starting Tika", "args", cmd.Args)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan struct{})
+	s.mu.Lock()
+	s.proc = cmd.Process
+	s.exited = exited
+	s.mu.Unlock()
+	go func() {
+		err := cmd.Wait()
+		Log.Info("Tika ended", "error", err)
+		close(exited)
+	}()
+	return nil
+}
+
+// kill terminates the current Tika process, waiting on the single reaper
+// goroutine started by spawn rather than calling proc.Wait itself - Wait may
+// only be called once per process, and spawn already owns that call.
+func (s *tikaSupervisor) kill() error {
+	s.mu.Lock()
+	proc := s.proc
+	exited := s.exited
+	s.proc = nil
+	s.exited = nil
+	s.mu.Unlock()
+	if proc == nil {
+		return nil
+	}
+	if err := proc.Signal(syscall.SIGTERM); err != nil {
+		Log.Warn("TERMinating Tika", "pid", proc.Pid, "error", err)
+	}
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		if err := proc.Kill(); err != nil {
+			Log.Warn("KILLing Tika", "pid", proc.Pid, "error", err)
+		}
+		<-exited
+	}
+	return nil
+}
+
+// acquire reserves a slot for one in-flight call to Tika, refusing while a
+// restart is draining the previous ones.
+func (s *tikaSupervisor) acquire() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return fmt.Errorf("tika is restarting, try again")
+	}
+	s.inflight.Add(1)
+	return nil
+}
+
+func (s *tikaSupervisor) release() { s.inflight.Done() }
+
+// Shutdown gracefully stops the supervised Tika process; a no-op when Tika
+// is externally managed.
+func (s *tikaSupervisor) Shutdown() {
+	if !s.managed() {
+		return
+	}
+	if err := s.kill(); err != nil {
+		Log.Warn("shutdown tika", "error", err)
+	}
+}
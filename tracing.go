@@ -0,0 +1,147 @@
+// Copyright 2016 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	otbridge "go.opentelemetry.io/otel/bridge/opentracing"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/trace"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	zipkinot "github.com/openzipkin-contrib/zipkin-go-opentracing"
+	"github.com/openzipkin/zipkin-go"
+	zipkinhttp "github.com/openzipkin/zipkin-go/reporter/http"
+	jaeger "github.com/uber/jaeger-client-go"
+	jaegercfg "github.com/uber/jaeger-client-go/config"
+)
+
+// initTracer sets up the global OpenTracing tracer for the given backend and
+// returns a closer to flush/shutdown it on exit. backend "none" (or empty)
+// installs a no-op tracer.
+func initTracer(backend, endpoint, serviceName string, sampleRate float64) (io.Closer, error) {
+	switch backend {
+	case "", "none":
+		opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+		return closerFunc(func() error { return nil }), nil
+
+	case "jaeger":
+		cfg := jaegercfg.Configuration{
+			ServiceName: serviceName,
+			Sampler: &jaegercfg.SamplerConfig{
+				Type:  jaeger.SamplerTypeProbabilistic,
+				Param: sampleRate,
+			},
+			Reporter: &jaegercfg.ReporterConfig{
+				LocalAgentHostPort: endpoint,
+			},
+		}
+		tracer, closer, err := cfg.NewTracer()
+		if err != nil {
+			return nil, fmt.Errorf("init jaeger tracer: %v", err)
+		}
+		opentracing.SetGlobalTracer(tracer)
+		return closer, nil
+
+	case "zipkin":
+		reporter := zipkinhttp.NewReporter(endpoint)
+		localEndpoint, err := zipkin.NewEndpoint(serviceName, "")
+		if err != nil {
+			reporter.Close()
+			return nil, fmt.Errorf("init zipkin endpoint (%q): %v", serviceName, err)
+		}
+		sampler, err := zipkin.NewBoundarySampler(sampleRate, 0)
+		if err != nil {
+			reporter.Close()
+			return nil, fmt.Errorf("init zipkin sampler: %v", err)
+		}
+		nativeTracer, err := zipkin.NewTracer(
+			reporter,
+			zipkin.WithLocalEndpoint(localEndpoint),
+			zipkin.WithSampler(sampler),
+		)
+		if err != nil {
+			reporter.Close()
+			return nil, fmt.Errorf("init zipkin tracer: %v", err)
+		}
+		opentracing.SetGlobalTracer(zipkinot.Wrap(nativeTracer))
+		return reporter, nil
+
+	case "otlp":
+		exporter, err := otlptracegrpc.New(context.Background(), otlptracegrpc.WithEndpoint(endpoint), otlptracegrpc.WithInsecure())
+		if err != nil {
+			return nil, fmt.Errorf("init otlp exporter (%q): %v", endpoint, err)
+		}
+		tp := trace.NewTracerProvider(
+			trace.WithBatcher(exporter),
+			trace.WithSampler(trace.TraceIDRatioBased(sampleRate)),
+		)
+		bridgeTracer, _ := otbridge.NewTracerPair(tp.Tracer(serviceName))
+		opentracing.SetGlobalTracer(bridgeTracer)
+		return closerFunc(func() error {
+			return tp.Shutdown(context.Background())
+		}), nil
+
+	default:
+		return nil, fmt.Errorf("unknown tracing backend %q", backend)
+	}
+}
+
+// closerFunc adapts a plain func() error to io.Closer.
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+// tracingTransport wraps an http.RoundTripper, starting a child span for
+// every outgoing request (Tika calls) and propagating the span context in
+// the request headers.
+type tracingTransport struct {
+	rt http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	span, ctx := opentracing.StartSpanFromContext(req.Context(), "tika."+req.Method+" "+req.URL.Path)
+	defer span.Finish()
+	ext.HTTPMethod.Set(span, req.Method)
+	ext.HTTPUrl.Set(span, req.URL.String())
+	req = req.WithContext(ctx)
+	opentracing.GlobalTracer().Inject(span.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header))
+
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil {
+		ext.Error.Set(span, true)
+		span.SetTag("error.message", err.Error())
+		return resp, err
+	}
+	ext.HTTPStatusCode.Set(span, uint16(resp.StatusCode))
+	return resp, err
+}
+
+// startRequestSpan extracts any parent span context propagated in the
+// incoming request's headers and starts a server-side span for op, returning
+// a context carrying it that handlers should thread through to analyze/store.
+func startRequestSpan(r *http.Request, op string) (opentracing.Span, context.Context) {
+	spanCtx, _ := opentracing.GlobalTracer().Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	span := opentracing.StartSpan(op, ext.RPCServerOption(spanCtx))
+	ext.HTTPMethod.Set(span, r.Method)
+	ext.HTTPUrl.Set(span, r.URL.String())
+	return span, opentracing.ContextWithSpan(r.Context(), span)
+}